@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// blockSize is the granularity at which ranges are fetched and cached.
+// Reads are rounded out to block boundaries so that sequential access
+// patterns reuse cached blocks instead of re-fetching overlapping ranges.
+const blockSize = 256 * 1024
+
+// maxCachedBlocks bounds the in-memory block cache. At blockSize bytes per
+// entry this caps memory use to a few hundred megabytes, which is enough to
+// keep a handful of actively-read files warm without competing with the
+// kernel's own page cache.
+const maxCachedBlocks = 1024
+
+// blockKey identifies a single cached block. etag is included so that a
+// remote write invalidates old blocks implicitly: once the ETag changes, the
+// old entries simply become unreachable and age out of the LRU.
+type blockKey struct {
+	path  string
+	etag  string
+	block int64
+}
+
+type blockCache struct {
+	mu  sync.Mutex
+	lru *list.List // of *blockEntry, most-recently-used at the front
+	idx map[blockKey]*list.Element
+}
+
+type blockEntry struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{
+		lru: list.New(),
+		idx: make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.idx[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockEntry).data, true
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.idx[key]; ok {
+		e.Value.(*blockEntry).data = data
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	e := c.lru.PushFront(&blockEntry{key: key, data: data})
+	c.idx[key] = e
+
+	for c.lru.Len() > maxCachedBlocks {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.lru.Remove(oldest)
+		delete(c.idx, oldest.Value.(*blockEntry).key)
+	}
+}
+
+// invalidate drops every cached block for path, regardless of ETag. Used
+// when we know a path has changed but don't have (or don't trust) the old
+// ETag, e.g. after a local write.
+func (c *blockCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.idx {
+		if key.path == path {
+			c.lru.Remove(e)
+			delete(c.idx, key)
+		}
+	}
+}
+
+var blocks = newBlockCache()
@@ -0,0 +1,202 @@
+// Package cache implements a content-addressed on-disk store for CBFS
+// blobs, keyed by the SHA-1 object ID that CBFS already assigns each file.
+// It's organized the same way git's object store is: the first two hex
+// digits of the OID become a fan-out directory, keeping any one directory
+// from growing unreasonably large.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrCorrupt describes a blob whose contents don't hash to the OID its path
+// implies. Nothing in this package returns it: Verify removes such blobs
+// instead of reporting them, and Put reports a mismatch with its own error.
+var ErrCorrupt = errors.New("cache: blob does not match its object ID")
+
+// Disk is an LRU-bounded, content-addressed blob cache rooted at a
+// directory on local disk.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *entry, most-recently-used at the front
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	oid  string
+	size int64
+}
+
+// Open prepares dir as a cache store, creating it if necessary, and primes
+// the LRU from whatever blobs are already on disk.
+func Open(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || len(fi.Name()) != 2 {
+			continue
+		}
+		sub, err := ioutil.ReadDir(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range sub {
+			if f.IsDir() {
+				continue
+			}
+			oid := f.Name()
+			e := d.lru.PushBack(&entry{oid: oid, size: f.Size()})
+			d.entries[oid] = e
+			d.size += f.Size()
+		}
+	}
+	d.evict()
+
+	return d, nil
+}
+
+func (d *Disk) path(oid string) string {
+	return filepath.Join(d.dir, oid[:2], oid)
+}
+
+// Get opens the cached blob for oid, if present, touching its LRU entry.
+func (d *Disk) Get(oid string) (io.ReadCloser, bool) {
+	d.mu.Lock()
+	e, ok := d.entries[oid]
+	if ok {
+		d.lru.MoveToFront(e)
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(d.path(oid))
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// Put stores r under oid, verifying that its contents actually hash to oid
+// before making it visible to Get.
+func (d *Disk) Put(oid string, r io.Reader) error {
+	dir := filepath.Join(d.dir, oid[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha1.New()
+	n, err := io.Copy(tmp, io.TeeReader(r, h))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+		return fmt.Errorf("cache: Put(%s): content hashed to %s", oid, got)
+	}
+
+	if err := os.Rename(tmp.Name(), d.path(oid)); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if e, ok := d.entries[oid]; ok {
+		d.size -= e.Value.(*entry).size
+		d.lru.MoveToFront(e)
+		e.Value.(*entry).size = n
+	} else {
+		e := d.lru.PushFront(&entry{oid: oid, size: n})
+		d.entries[oid] = e
+	}
+	d.size += n
+	d.mu.Unlock()
+
+	d.evict()
+	return nil
+}
+
+// evict drops least-recently-used blobs until the cache fits within
+// maxBytes.
+func (d *Disk) evict() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.maxBytes <= 0 {
+		return
+	}
+	for d.size > d.maxBytes {
+		oldest := d.lru.Back()
+		if oldest == nil {
+			break
+		}
+		e := oldest.Value.(*entry)
+		d.lru.Remove(oldest)
+		delete(d.entries, e.oid)
+		d.size -= e.size
+		os.Remove(d.path(e.oid))
+	}
+}
+
+// Verify walks every blob in dir and confirms its contents hash to the OID
+// implied by its path, removing any that don't. It's meant to be run as an
+// offline fsck, not during normal operation.
+func Verify(dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		oid := filepath.Base(p)
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		h := sha1.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+			fmt.Printf("cache: removing corrupt blob %s (hashed to %s)\n", p, got)
+			return os.Remove(p)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpoint is one CBFS frontend we know about. Reads are routed to whichever
+// healthy endpoint currently has the lowest observed latency; writes fan out
+// to all of them and only need a quorum of acknowledgements.
+type endpoint struct {
+	url *url.URL
+
+	mu      sync.Mutex
+	healthy bool
+	backoff time.Duration
+	latency time.Duration
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+func newEndpoint(u *url.URL) *endpoint {
+	return &endpoint{url: u, healthy: true, backoff: minBackoff}
+}
+
+func (e *endpoint) markHealthy(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = true
+	e.backoff = minBackoff
+	// Exponential moving average so a single slow request doesn't make us
+	// thrash between endpoints.
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (e.latency*3 + latency) / 4
+	}
+}
+
+func (e *endpoint) markUnhealthy() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = false
+	e.backoff *= 2
+	if e.backoff > maxBackoff {
+		e.backoff = maxBackoff
+	}
+}
+
+func (e *endpoint) isHealthy() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy
+}
+
+func (e *endpoint) snapshot() (healthy bool, latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy, e.latency
+}
+
+// resolve builds the URL this endpoint would use for p, which may include a
+// "?query" suffix.
+func (e *endpoint) resolve(p string) *url.URL {
+	u := *e.url
+	if i := strings.IndexByte(p, '?'); i >= 0 {
+		u.Path = p[:i]
+		u.RawQuery = p[i+1:]
+	} else {
+		u.Path = p
+		u.RawQuery = ""
+	}
+	return &u
+}
+
+// endpointSet is every configured CBFS frontend, plus the quorum size
+// required for a write to be considered successful.
+type endpointSet struct {
+	all    []*endpoint
+	quorum int
+}
+
+var endpoints *endpointSet
+
+func parseEndpoints(roots string, writeQuorum int) (*endpointSet, error) {
+	var all []*endpoint
+	for _, s := range strings.Split(roots, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -root: %v", err)
+		}
+		all = append(all, newEndpoint(u))
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("no CBFS endpoints configured")
+	}
+
+	if writeQuorum <= 0 {
+		writeQuorum = len(all)/2 + 1
+	}
+	if writeQuorum > len(all) {
+		writeQuorum = len(all)
+	}
+
+	return &endpointSet{all: all, quorum: writeQuorum}, nil
+}
+
+// byLatency returns the healthy endpoints ordered fastest-first, followed by
+// the unhealthy ones (as a last resort, so a total outage of the health
+// checker doesn't wedge every read).
+func (s *endpointSet) byLatency() []*endpoint {
+	healthy := make([]*endpoint, 0, len(s.all))
+	unhealthy := make([]*endpoint, 0, len(s.all))
+	for _, e := range s.all {
+		if e.isHealthy() {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	sortByLatency(healthy)
+	return append(healthy, unhealthy...)
+}
+
+func sortByLatency(eps []*endpoint) {
+	for i := 1; i < len(eps); i++ {
+		for j := i; j > 0; j-- {
+			_, li := eps[j].snapshot()
+			_, lj := eps[j-1].snapshot()
+			if li >= lj {
+				break
+			}
+			eps[j], eps[j-1] = eps[j-1], eps[j]
+		}
+	}
+}
+
+// doRequest issues method against the fastest healthy endpoint, failing
+// over to the next one on a network error or a 5xx response. mutate, if
+// non-nil, is called on each attempt's request before it's sent (so e.g.
+// Range headers get set consistently across retries).
+func (s *endpointSet) doRequest(method, path string, mutate func(*http.Request)) (*http.Response, *endpoint, error) {
+	var lastErr error
+	for _, e := range s.byLatency() {
+		req, err := http.NewRequest(method, e.resolve(path).String(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mutate != nil {
+			mutate(req)
+		}
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			e.markUnhealthy()
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("%s %s: %s", method, path, resp.Status)
+			resp.Body.Close()
+			e.markUnhealthy()
+			continue
+		}
+		e.markHealthy(time.Since(start))
+		return resp, e, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%s %s: no endpoints available", method, path)
+	}
+	return nil, nil, lastErr
+}
+
+func (s *endpointSet) doGet(path string) (*http.Response, *endpoint, error) {
+	return s.doRequest("GET", path, nil)
+}
+
+func (s *endpointSet) doHead(path string) (*http.Response, *endpoint, error) {
+	return s.doRequest("HEAD", path, nil)
+}
+
+// doRangeGet fetches a byte range of path, failing over across endpoints on
+// error the same way doRequest does. It deliberately doesn't send If-Match:
+// conditioning a ranged read on the ETag would turn a replica that's merely
+// behind - exactly the case this multi-endpoint failover exists to route
+// around - into a hard read failure instead of a fallback to the next
+// endpoint.
+func (s *endpointSet) doRangeGet(path string, start, end int64) (*http.Response, error) {
+	resp, _, err := s.doRequest("GET", path, func(r *http.Request) {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	})
+	return resp, err
+}
+
+// quorumResult is one endpoint's outcome from a fan-out write.
+type quorumResult struct {
+	endpoint *endpoint
+	resp     *http.Response
+	err      error
+}
+
+// fanOut runs do against every configured endpoint concurrently and waits
+// for all of them to finish, updating each endpoint's health along the way.
+func (s *endpointSet) fanOut(do func(e *endpoint) (*http.Response, error)) []quorumResult {
+	results := make([]quorumResult, len(s.all))
+	var wg sync.WaitGroup
+	for i, e := range s.all {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			start := time.Now()
+			resp, err := do(e)
+			switch {
+			case err != nil:
+				e.markUnhealthy()
+			case resp.StatusCode >= 500:
+				e.markUnhealthy()
+			default:
+				e.markHealthy(time.Since(start))
+			}
+			results[i] = quorumResult{endpoint: e, resp: resp, err: err}
+		}(i, e)
+	}
+	wg.Wait()
+	return results
+}
+
+// errPreconditionFailed is returned by putQuorum when fewer than a quorum
+// of endpoints succeeded and at least one of them rejected the write with
+// 412 Precondition Failed (an If-Match mismatch), so the caller can tell a
+// stale write from a genuine outage.
+type errPreconditionFailed struct{ path string }
+
+func (e *errPreconditionFailed) Error() string {
+	return fmt.Sprintf("PUT %s: 412 Precondition Failed", e.path)
+}
+
+func isPreconditionFailed(err error) bool {
+	_, ok := err.(*errPreconditionFailed)
+	return ok
+}
+
+// putQuorum PUTs body to path on every configured endpoint and succeeds once
+// at least the configured quorum respond with a 2xx status. It waits for
+// every endpoint to finish; the returned ETag/OID come from the
+// earliest-configured successful endpoint that sent a non-empty ETag.
+func (s *endpointSet) putQuorum(path string, body []byte, mutate func(*http.Request)) (etag, oid string, err error) {
+	results := s.fanOut(func(e *endpoint) (*http.Response, error) {
+		req, err := http.NewRequest("PUT", e.resolve(path).String(), ioutil.NopCloser(bytes.NewReader(body)))
+		if err != nil {
+			return nil, err
+		}
+		if mutate != nil {
+			mutate(req)
+		}
+		return http.DefaultClient.Do(req)
+	})
+
+	ok, preconditionFailed := 0, false
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, r.resp.Body)
+		r.resp.Body.Close()
+		if r.resp.StatusCode == http.StatusPreconditionFailed {
+			preconditionFailed = true
+			continue
+		}
+		if r.resp.StatusCode/100 != 2 {
+			continue
+		}
+		ok++
+		if etag == "" {
+			etag = r.resp.Header.Get("ETag")
+			oid = r.resp.Header.Get("X-CBFS-OID")
+		}
+	}
+
+	if ok < s.quorum {
+		if preconditionFailed {
+			return "", "", &errPreconditionFailed{path: path}
+		}
+		return "", "", fmt.Errorf("PUT %s: only %d/%d endpoints acknowledged (need %d)", path, ok, len(results), s.quorum)
+	}
+	return etag, oid, nil
+}
+
+// deleteQuorum DELETEs path from every configured endpoint and succeeds once
+// at least the configured quorum respond with a 2xx status (CBFS returns 404
+// for a path that's already gone on some replica, which we also accept).
+func (s *endpointSet) deleteQuorum(path string) error {
+	results := s.fanOut(func(e *endpoint) (*http.Response, error) {
+		req, err := http.NewRequest("DELETE", e.resolve(path).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
+	})
+
+	ok := 0
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, r.resp.Body)
+		r.resp.Body.Close()
+		if r.resp.StatusCode/100 == 2 || r.resp.StatusCode == http.StatusNotFound {
+			ok++
+		}
+	}
+
+	if ok < s.quorum {
+		return fmt.Errorf("DELETE %s: only %d/%d endpoints acknowledged (need %d)", path, ok, len(results), s.quorum)
+	}
+	return nil
+}
+
+// healthChecker periodically probes every endpoint so that a recovered
+// backend is noticed even if nothing happens to read or write through it.
+func healthChecker() {
+	for {
+		for _, e := range endpoints.all {
+			e.mu.Lock()
+			backoff := e.backoff
+			e.mu.Unlock()
+
+			go func(e *endpoint) {
+				start := time.Now()
+				resp, err := http.Head(e.resolve("/").String())
+				if err != nil || resp.StatusCode >= 500 {
+					e.markUnhealthy()
+					if err != nil {
+						log.Printf("healthCheck(%s): %v", e.url, err)
+					} else {
+						resp.Body.Close()
+					}
+					return
+				}
+				resp.Body.Close()
+				e.markHealthy(time.Since(start))
+			}(e)
+
+			time.Sleep(backoff)
+		}
+	}
+}
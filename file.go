@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// File represents a single CBFS object. Unlike the original implementation,
+// it no longer keeps the object's body in memory: reads are served in
+// page-sized windows straight from CBFS (through the block cache), and
+// writes land in a sparse, page-sized dirty map that's only assembled and
+// re-uploaded when Flush or Fsync is called.
+type File struct {
+	Path     string
+	Size     uint64
+	OID      string
+	ETag     string
+	Revno    string
+	Headers  map[string]string
+	Modified time.Time
+
+	// internal fields
+	mu         sync.Mutex
+	dirtyPages map[int64][]byte // block index -> page contents, nil until first write
+	dirtySize  uint64           // logical file size while dirtyPages != nil
+	baseSize   uint64           // remote size as of when dirtyPages was created
+	stale      bool
+	at         time.Time
+}
+
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mu.Lock()
+	size := f.Size
+	if f.dirtyPages != nil {
+		size = f.dirtySize
+	}
+	mtime := f.Modified
+	f.mu.Unlock()
+
+	a.Mode = 0644
+	a.Size = size
+	a.Mtime = mtime
+	return nil
+}
+
+// Listxattr exposes the CBFS metadata we keep about this object as
+// user.cbfs.* extended attributes.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append("user.cbfs.oid", "user.cbfs.revno", "user.cbfs.headers")
+	return nil
+}
+
+// Getxattr serves the individual user.cbfs.* attributes Listxattr
+// advertises.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req.Name {
+	case "user.cbfs.oid":
+		resp.Xattr = []byte(f.OID)
+	case "user.cbfs.revno":
+		resp.Xattr = []byte(f.Revno)
+	case "user.cbfs.headers":
+		b, err := json.Marshal(f.Headers)
+		if err != nil {
+			return err
+		}
+		resp.Xattr = b
+	default:
+		return fuse.ErrNoXattr
+	}
+	return nil
+}
+
+func (f *File) checkStale(ctx context.Context) bool {
+	if f.stale || time.Since(f.at) > time.Minute {
+		d, err := fetchDir(path.Dir(f.Path))
+		if err != nil {
+			return true
+		}
+		node, err := d.Lookup(ctx, path.Base(f.Path))
+		if err != nil {
+			return true
+		}
+		file, _ := node.(*File)
+		if file == nil {
+			return true
+		}
+		// Lookup registered its throwaway node; f is the one the kernel holds.
+		registry.assign(f.Path, f)
+		f.mu.Lock()
+		f.Size, f.Revno, f.Headers, f.Modified, f.at = file.Size, file.Revno, file.Headers, file.Modified, file.at
+		if f.dirtyPages == nil {
+			// Pending writes stay conditioned on the ETag they were based on.
+			f.ETag = file.ETag
+		}
+		f.mu.Unlock()
+	}
+	return false
+}
+
+// Read services a single ranged read by fetching (and caching) the blocks
+// that overlap the requested window, rather than slurping the whole object.
+func (f *File) Read(ctx context.Context, r *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if f.checkStale(ctx) {
+		return syscall.EIO
+	}
+
+	f.mu.Lock()
+	etag, size := f.ETag, f.Size
+	dirty := f.dirtyPages != nil
+	if dirty {
+		size = f.dirtySize
+	}
+	f.mu.Unlock()
+
+	if dirty {
+		// Serve out of the not-yet-flushed page map, falling back to the
+		// base content (through the normal block path) for any page that
+		// hasn't been written yet.
+		start := r.Offset
+		if start > int64(size) {
+			start = int64(size)
+		}
+		end := start + int64(r.Size)
+		if end > int64(size) {
+			end = int64(size)
+		}
+
+		buf := make([]byte, 0, end-start)
+		for b := start / blockSize; b <= (end-1)/blockSize && start < end; b++ {
+			data, err := f.readDirtyOrBaseBlock(etag, b)
+			if err != nil {
+				log.Printf("Read(%q) => %v", f.Path, err)
+				return syscall.EIO
+			}
+			lo := int64(0)
+			if b == start/blockSize {
+				lo = start - b*blockSize
+			}
+			hi := int64(len(data))
+			if want := end - b*blockSize; want < hi {
+				hi = want
+			}
+			if lo > hi {
+				lo = hi
+			}
+			buf = append(buf, data[lo:hi]...)
+		}
+		resp.Data = buf
+		return nil
+	}
+
+	if r.Offset >= int64(size) {
+		resp.Data = nil
+		return nil
+	}
+
+	end := r.Offset + int64(r.Size)
+	if end > int64(size) {
+		end = int64(size)
+	}
+
+	firstBlock := r.Offset / blockSize
+	lastBlock := (end - 1) / blockSize
+
+	buf := make([]byte, 0, end-r.Offset)
+	for b := firstBlock; b <= lastBlock; b++ {
+		data, err := f.readBlock(etag, b)
+		if err != nil {
+			log.Printf("Read(%q) => %v", f.Path, err)
+			return syscall.EIO
+		}
+		lo := int64(0)
+		if b == firstBlock {
+			lo = r.Offset - b*blockSize
+		}
+		hi := int64(len(data))
+		if b == lastBlock {
+			if want := end - b*blockSize; want < hi {
+				hi = want
+			}
+		}
+		if lo > hi {
+			lo = hi
+		}
+		buf = append(buf, data[lo:hi]...)
+	}
+
+	resp.Data = buf
+	return nil
+}
+
+func (f *File) readBlock(etag string, block int64) ([]byte, error) {
+	key := blockKey{path: f.Path, etag: etag, block: block}
+	if data, ok := blocks.get(key); ok {
+		return data, nil
+	}
+
+	if data, ok := f.readBlockFromDiskCache(block); ok {
+		blocks.put(key, data)
+		return data, nil
+	}
+
+	resp, err := endpoints.doRangeGet(f.Path, block*blockSize, block*blockSize+blockSize-1)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", f.Path, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks.put(key, data)
+	return data, nil
+}
+
+// readBlockFromDiskCache serves a block straight out of the local disk
+// cache, if the whole blob happens to be cached under its OID.
+func (f *File) readBlockFromDiskCache(block int64) ([]byte, bool) {
+	if diskCache == nil || f.OID == "" {
+		return nil, false
+	}
+
+	rc, ok := diskCache.Get(f.OID)
+	if !ok {
+		return nil, false
+	}
+	defer rc.Close()
+
+	start := block * blockSize
+	if _, err := io.CopyN(ioutil.Discard, rc, start); err != nil {
+		return nil, false
+	}
+
+	buf := make([]byte, blockSize)
+	n, err := io.ReadFull(rc, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+// readDirtyOrBaseBlock returns block b of the file as it stands with
+// pending writes applied: the dirty page if one was written, otherwise the
+// base content fetched (and cached) the normal way.
+func (f *File) readDirtyOrBaseBlock(etag string, b int64) ([]byte, error) {
+	if page, ok := f.dirtyPages[b]; ok {
+		return page, nil
+	}
+	blockStart := uint64(b * blockSize)
+	if blockStart >= f.baseSize {
+		if blockStart < f.dirtySize {
+			// Past the base content but within the file's (possibly grown)
+			// dirty size: an unwritten hole, which reads back as zeroes.
+			return make([]byte, blockSize), nil
+		}
+		return nil, nil
+	}
+	data, err := f.readBlock(etag, b)
+	if err != nil {
+		return nil, err
+	}
+	if f.dirtySize > blockStart {
+		// The file grew within this same base block (a Write past the old
+		// end, or a Setattr truncation up), so the base content alone is
+		// shorter than what should now read back; pad the gap with zeroes
+		// instead of returning a short block.
+		if want := f.dirtySize - blockStart; want > uint64(len(data)) {
+			if want > blockSize {
+				want = blockSize
+			}
+			padded := make([]byte, want)
+			copy(padded, data)
+			return padded, nil
+		}
+	}
+	return data, nil
+}
+
+// Write applies r to the sparse, page-sized dirty map; nothing is uploaded
+// until Flush or Fsync (base blocks a write lands in may still be fetched).
+func (f *File) Write(ctx context.Context, r *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if *readOnly {
+		return syscall.EPERM
+	}
+	if f.checkStale(ctx) {
+		return syscall.EIO
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dirtyPages == nil {
+		f.dirtyPages = make(map[int64][]byte)
+		f.baseSize = f.Size
+		f.dirtySize = f.Size
+	}
+
+	data := r.Data
+	offset := r.Offset
+	for len(data) > 0 {
+		b := offset / blockSize
+		pageOff := offset % blockSize
+
+		page, ok := f.dirtyPages[b]
+		if !ok {
+			base, err := f.readDirtyOrBaseBlock(f.ETag, b)
+			if err != nil {
+				log.Printf("Write(%q) => %v", f.Path, err)
+				return syscall.EIO
+			}
+			// base may be the exact slice the block cache is holding onto;
+			// copy it before mutating so an in-place write can't leak
+			// uncommitted bytes into the shared, etag-keyed read cache.
+			page = append([]byte(nil), base...)
+		}
+
+		need := pageOff + int64(len(data))
+		if need > blockSize {
+			need = blockSize
+		}
+		n := need - pageOff
+		if int64(len(page)) < need {
+			grown := make([]byte, need)
+			copy(grown, page)
+			page = grown
+		}
+		copy(page[pageOff:need], data[:n])
+		f.dirtyPages[b] = page
+
+		if end := uint64(b*blockSize + need); end > f.dirtySize {
+			f.dirtySize = end
+		}
+		data = data[n:]
+		offset += n
+	}
+
+	resp.Size = len(r.Data)
+	return nil
+}
+
+func (f *File) Setattr(ctx context.Context, r *fuse.SetattrRequest, w *fuse.SetattrResponse) error {
+	if *readOnly {
+		return syscall.EPERM
+	}
+	if f.checkStale(ctx) {
+		return syscall.EIO
+	}
+
+	if r.Valid&fuse.SetattrSize == fuse.SetattrSize {
+		f.mu.Lock()
+		if f.dirtyPages == nil {
+			f.dirtyPages = make(map[int64][]byte)
+			f.baseSize = f.Size
+		}
+
+		last := int64(r.Size) / blockSize
+		for b, page := range f.dirtyPages {
+			switch {
+			case b > last:
+				delete(f.dirtyPages, b)
+			case b == last:
+				if cut := r.Size % blockSize; uint64(len(page)) > cut {
+					f.dirtyPages[b] = page[:cut]
+				}
+			}
+		}
+		f.dirtySize = r.Size
+		f.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Flush uploads any buffered writes as a single PUT, conditioned on the
+// ETag the file had when we started writing.
+func (f *File) Flush(ctx context.Context, r *fuse.FlushRequest) error {
+	// Flush fires on every close(2), including files opened only for
+	// reading, so it can't reject outright in read-only mode the way
+	// Write and Setattr do. No dirty pages can exist when -read-only is
+	// set, so f.flush() is already a no-op here.
+	return f.flush()
+}
+
+func (f *File) Fsync(ctx context.Context, r *fuse.FsyncRequest) error {
+	if *readOnly {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *File) flush() error {
+	f.mu.Lock()
+	dirty := f.dirtyPages
+	f.mu.Unlock()
+
+	if dirty == nil {
+		return nil
+	}
+
+	body, err := f.assemble()
+	if err != nil {
+		log.Printf("Flush(%q) => %v", f.Path, err)
+		return syscall.EIO
+	}
+
+	f.mu.Lock()
+	baseETag := f.ETag
+	f.mu.Unlock()
+
+	etag, oid, err := uploadChunked(f.Path, body, baseETag)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			log.Printf("Flush(%q): remote changed underneath us, discarding write", f.Path)
+			f.mu.Lock()
+			f.dirtyPages = nil
+			f.dirtySize = 0
+			f.stale = true
+			f.mu.Unlock()
+		} else {
+			log.Printf("Flush(%q) => %v", f.Path, err)
+		}
+		return syscall.EIO
+	}
+
+	blocks.invalidate(f.Path)
+
+	f.mu.Lock()
+	f.ETag = etag
+	f.OID = oid
+	f.Size = uint64(len(body))
+	f.dirtyPages = nil
+	f.dirtySize = 0
+	f.stale = true
+	f.mu.Unlock()
+
+	return nil
+}
+
+// assemble reconstructs the file's full pending content by combining
+// written pages with base content read (and cached) the normal way. Must be
+// called without f.mu held, since it takes f.mu itself around each block
+// read (including any network request that read makes).
+func (f *File) assemble() ([]byte, error) {
+	f.mu.Lock()
+	size := f.dirtySize
+	etag := f.ETag
+	f.mu.Unlock()
+
+	body := make([]byte, size)
+	pages := (int64(size) + blockSize - 1) / blockSize
+	for b := int64(0); b < pages; b++ {
+		f.mu.Lock()
+		data, err := f.readDirtyOrBaseBlock(etag, b)
+		f.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		start := b * blockSize
+		end := start + int64(len(data))
+		if end > int64(size) {
+			end = int64(size)
+		}
+		if end > start {
+			copy(body[start:end], data[:end-start])
+		}
+	}
+	return body, nil
+}
+
+// uploadChunked PUTs b to every configured CBFS endpoint, conditioned on
+// ifMatch (skip the check with an empty string), succeeding once a write
+// quorum of them has acknowledged it. On success it also seeds the disk
+// cache with the uploaded bytes under the OID CBFS assigned them, since we
+// already have them in memory.
+func uploadChunked(path string, b []byte, ifMatch string) (etag, oid string, err error) {
+	var mutate func(*http.Request)
+	if ifMatch != "" {
+		mutate = func(req *http.Request) { req.Header.Set("If-Match", ifMatch) }
+	}
+
+	etag, oid, err = endpoints.putQuorum(path, b, mutate)
+	if err != nil {
+		return "", "", err
+	}
+
+	if diskCache != nil && oid != "" {
+		if err := diskCache.Put(oid, bytes.NewReader(b)); err != nil {
+			log.Printf("uploadChunked(%q): caching %s: %v", path, oid, err)
+		}
+	}
+
+	return etag, oid, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// srv is the live FUSE server, set once in main after mounting. It's needed
+// here so background goroutines can push invalidations back into the kernel
+// outside of any particular Node method call.
+var srv *fs.Server
+
+// registry maps CBFS paths to the Node we last handed the kernel for them,
+// so that a change noticed out-of-band (via the events stream or a poll) can
+// be turned into the InvalidateNodeData/InvalidateEntry calls the kernel
+// expects; both take the Node itself rather than a path.
+type nodeRegistry struct {
+	mu     sync.Mutex
+	byPath map[string]fs.Node
+}
+
+var registry = &nodeRegistry{
+	byPath: make(map[string]fs.Node),
+}
+
+// assign records n as the current Node for p, overwriting whatever was
+// there before.
+func (r *nodeRegistry) assign(p string, n fs.Node) {
+	p = path.Clean(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byPath[p] = n
+}
+
+func (r *nodeRegistry) lookup(p string) (fs.Node, bool) {
+	p = path.Clean(p)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.byPath[p]
+	return n, ok
+}
+
+// cbfsEvent is one line of the /.cbfs/events change feed.
+type cbfsEvent struct {
+	Path string `json:"path"`
+	Op   string `json:"op"`
+}
+
+// watchInvalidations runs for the lifetime of the mount, keeping the
+// kernel's dcache/pagecache in sync with remote changes. It prefers the
+// server's event stream and falls back to polling directory listings when
+// the stream isn't available.
+func watchInvalidations() {
+	for {
+		err := streamEvents(invalidatePath)
+		if err != nil {
+			log.Printf("events stream: %v; falling back to polling", err)
+			pollLoop()
+			return
+		}
+	}
+}
+
+func streamEvents(handle func(string)) error {
+	resp, _, err := endpoints.doGet("/.cbfs/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &eventsUnavailable{resp.Status}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev cbfsEvent
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		handle(ev.Path)
+	}
+}
+
+type eventsUnavailable struct{ status string }
+
+func (e *eventsUnavailable) Error() string { return "GET /.cbfs/events: " + e.status }
+
+// pollLoop is the fallback for CBFS servers that don't expose the events
+// stream: it periodically re-lists every directory we've already served and
+// diffs the result against the last listing we saw.
+func pollLoop() {
+	for range time.Tick(time.Minute) {
+		for _, p := range knownDirs() {
+			pollDir(p)
+		}
+	}
+}
+
+var dirSnapshots = struct {
+	mu   sync.Mutex
+	dirs map[string]*Dir
+}{dirs: make(map[string]*Dir)}
+
+func noteDir(d *Dir) {
+	dirSnapshots.mu.Lock()
+	prev := dirSnapshots.dirs[d.Path]
+	cp := *d
+	dirSnapshots.dirs[d.Path] = &cp
+	dirSnapshots.mu.Unlock()
+
+	if prev != nil {
+		diffDirs(prev, d)
+	}
+}
+
+func knownDirs() []string {
+	dirSnapshots.mu.Lock()
+	defer dirSnapshots.mu.Unlock()
+	paths := make([]string, 0, len(dirSnapshots.dirs))
+	for p := range dirSnapshots.dirs {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func pollDir(p string) {
+	n, ok := registry.lookup(p)
+	if !ok {
+		return
+	}
+	d, ok := n.(*Dir)
+	if !ok {
+		return
+	}
+	if err := refreshDir(d); err != nil {
+		log.Printf("pollDir(%q) => %v", p, err)
+	}
+	// refreshDir already calls noteDir, which performs the diff
+}
+
+func diffDirs(prev, cur *Dir) {
+	for name, f := range cur.Files {
+		if old, ok := prev.Files[name]; !ok || old.Modified != f.Modified || old.Size != f.Size {
+			invalidatePath(path.Join(cur.Path, name))
+		}
+	}
+	for name := range prev.Files {
+		if _, ok := cur.Files[name]; !ok {
+			invalidatePath(path.Join(cur.Path, name))
+		}
+	}
+	for name := range prev.Dirs {
+		if _, ok := cur.Dirs[name]; !ok {
+			invalidatePath(path.Join(cur.Path, name))
+		}
+	}
+}
+
+// invalidatePath tells the kernel to drop its cached attributes/data for p
+// and its parent's directory entry for it, and drops our own block cache
+// for it too.
+func invalidatePath(p string) {
+	p = path.Clean(p)
+
+	if n, ok := registry.lookup(p); ok {
+		if err := srv.InvalidateNodeData(n); err != nil && err != fs.ErrNotCached {
+			log.Printf("InvalidateNodeData(%q): %v", p, err)
+		}
+	}
+
+	parent, name := path.Split(p)
+	parent = path.Clean(parent)
+	if pn, ok := registry.lookup(parent); ok {
+		if err := srv.InvalidateEntry(pn, name); err != nil && err != fs.ErrNotCached {
+			log.Printf("InvalidateEntry(%q, %q): %v", parent, name, err)
+		}
+	}
+
+	blocks.invalidate(p)
+}
@@ -1,60 +1,159 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
+	"syscall"
 	"time"
 
-	"code.google.com/p/rsc/fuse"
-)
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
 
-const DISABLE_WRITE = true
+	"github.com/BenLubar/cbfs-fuse/cache"
+)
 
 var (
-	mountpoint = flag.String("mnt", "/mnt/cbfs", "mount point")
-	root       = flag.String("root", "http://cbfs:8484/", "cbfs root url")
+	mountpoint   = flag.String("mnt", "/mnt/cbfs", "mount point")
+	root         = flag.String("root", "http://cbfs:8484/", "comma-separated list of cbfs root urls")
+	writeQuorum  = flag.Int("write-quorum", 0, "number of endpoints that must acknowledge a write (default: majority)")
+	cacheDir     = flag.String("cache-dir", "", "local disk cache directory (disabled if empty)")
+	cacheSize    = flag.Int64("cache-size", 1<<30, "maximum size in bytes of the local disk cache")
+	fsck         = flag.Bool("fsck", false, "verify the local disk cache against its blobs' object IDs, then exit")
+	readOnly     = flag.Bool("read-only", false, "mount the filesystem read-only")
+	volumeName   = flag.String("volume-name", "cbfs", "volume name reported to the OS")
+	allowOther   = flag.Bool("allow-other", false, "allow other users to access the mount")
+	maxReadahead = flag.Uint("max-readahead", 0, "maximum readahead in bytes requested from the kernel (default: kernel's own default)")
 )
 
-var rootURL *url.URL
+var diskCache *cache.Disk
 
 func main() {
 	flag.Parse()
 
-	c, err := fuse.Mount("/mnt/cbfs")
+	if *fsck {
+		if *cacheDir == "" {
+			log.Fatal("fsck: -cache-dir is required")
+		}
+		if err := cache.Verify(*cacheDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *cacheDir != "" {
+		d, err := cache.Open(*cacheDir, *cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		diskCache = d
+	}
+
+	eps, err := parseEndpoints(*root, *writeQuorum)
 	if err != nil {
 		log.Fatal(err)
 	}
+	endpoints = eps
+	go healthChecker()
 
-	rootURL, err = url.Parse(*root)
+	opts := []fuse.MountOption{
+		fuse.FSName("cbfs"),
+		fuse.Subtype("cbfs"),
+		fuse.VolumeName(*volumeName),
+	}
+	if *readOnly {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	if *allowOther {
+		opts = append(opts, fuse.AllowOther())
+	}
+	if *maxReadahead > 0 {
+		opts = append(opts, fuse.MaxReadahead(uint32(*maxReadahead)))
+	}
+
+	c, err := fuse.Mount(*mountpoint, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer c.Close()
+
+	srv = fs.New(c, nil)
 
-	c.Serve(CBFS{})
+	if c.Protocol().HasInvalidate() {
+		go watchInvalidations()
+	} else {
+		log.Print("cbfs: kernel protocol too old for invalidation notifications; staleness will be polled per-call")
+	}
+
+	if err := srv.Serve(CBFS{}); err != nil {
+		log.Fatal(err)
+	}
+
+	// check if the mount process has an error to report
+	<-c.Ready
+	if err := c.MountError; err != nil {
+		log.Fatal(err)
+	}
 }
 
 type CBFS struct{}
 
-func (CBFS) Root() (fuse.Node, fuse.Error) {
+func (CBFS) Root() (fs.Node, error) {
 	return GetDir("/")
 }
 
-func GetDir(p string) (*Dir, fuse.Error) {
-	u := *rootURL
-	u.Path = path.Join("/.cbfs/list", p) + "/"
-	u.RawQuery = "includeMeta=true"
-	resp, err := http.Get(u.String())
+// Statfs reports aggregate capacity across the CBFS cluster, summed from
+// every storage node's self-reported usage.
+func (CBFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	var nodes map[string]struct {
+		Size uint64 `json:"size"`
+		Used uint64 `json:"used"`
+	}
+	nresp, _, err := endpoints.doGet("/.cbfs/nodes")
+	if err != nil {
+		log.Printf("Statfs => %v", err)
+		return syscall.EIO
+	}
+	defer nresp.Body.Close()
+	if err := json.NewDecoder(nresp.Body).Decode(&nodes); err != nil {
+		log.Printf("Statfs => %v", err)
+		return syscall.EIO
+	}
+
+	const statfsBlockSize = 4096
+	var total, used uint64
+	for _, n := range nodes {
+		total += n.Size
+		used += n.Used
+	}
+
+	resp.Blocks = total / statfsBlockSize
+	resp.Bfree = (total - used) / statfsBlockSize
+	resp.Bavail = resp.Bfree
+	// CBFS has no cheap way to report an inode/file count, so leave
+	// Files/Ffree at zero rather than report something meaningless like
+	// the number of in-flight tasks.
+	resp.Bsize = uint32(statfsBlockSize)
+
+	return nil
+}
+
+// fetchDir retrieves the current directory listing for p from the server.
+// It doesn't touch the node registry; callers decide whether the result
+// becomes a new kernel-visible node (GetDir) or is merged into one that's
+// already registered (refreshDir).
+func fetchDir(p string) (*Dir, error) {
+	listPath := path.Join("/.cbfs/list", p) + "/?includeMeta=true"
+	resp, _, err := endpoints.doGet(listPath)
 	if err != nil {
 		log.Printf("GetDir(%q) => %v", p, err)
-		return nil, fuse.EIO
+		return nil, syscall.EIO
 	}
 	defer resp.Body.Close()
 
@@ -62,7 +161,7 @@ func GetDir(p string) (*Dir, fuse.Error) {
 	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
 		log.Printf("GetDir(%q) => %v", p, err)
 		if err != io.EOF {
-			return nil, fuse.EIO
+			return nil, syscall.EIO
 		}
 		return &Dir{
 			Path: path.Clean(p),
@@ -79,11 +178,39 @@ func GetDir(p string) (*Dir, fuse.Error) {
 	return &d, nil
 }
 
+// GetDir fetches p and registers the returned *Dir as the node the kernel
+// is being handed for it (via Root or a directory Lookup), so that a later
+// out-of-band change can be turned into an invalidation against this exact
+// node.
+func GetDir(p string) (*Dir, error) {
+	d, err := fetchDir(p)
+	if err != nil {
+		return nil, err
+	}
+	registry.assign(d.Path, d)
+	noteDir(d)
+	return d, nil
+}
+
+// refreshDir re-fetches n's directory and merges the result into n in
+// place, preserving n's identity so its registry entry - and therefore
+// kernel invalidation - stays valid across the refresh.
+func refreshDir(n *Dir) error {
+	d, err := fetchDir(n.Path)
+	if err != nil {
+		return err
+	}
+	*n = *d
+	noteDir(n)
+	return nil
+}
+
 type Dir struct {
 	Path  string `json:"path"`
 	Files map[string]struct {
 		Size     uint64    `json:"length"`
 		Modified time.Time `json:"modified"`
+		OID      string    `json:"oid"`
 	} `json:"files"`
 	Dirs map[string]struct {
 		Size uint64 `json:"size"`
@@ -95,77 +222,75 @@ type Dir struct {
 	at    time.Time
 }
 
-func (d *Dir) Attr() fuse.Attr {
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	if d.stale || time.Since(d.at) > time.Minute {
-		n, err := GetDir(d.Path)
-		if err == nil {
-			*d = *n
-		}
-	}
-	return fuse.Attr{
-		Mode: os.ModeDir | 0755,
-		Size: d.size,
+		refreshDir(d) // keep serving stale attrs on error
 	}
+	a.Mode = os.ModeDir | 0755
+	a.Size = d.size
+	return nil
 }
 
-func (d *Dir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	d.stale = true
 	if d.stale || time.Since(d.at) > time.Minute {
-		n, err := GetDir(d.Path)
-		if err != nil {
+		if err := refreshDir(d); err != nil {
 			return nil, err
 		}
-		*d = *n
 	}
 
-	if _, ok := d.Files[name]; ok {
-		u := *rootURL
-		u.Path = path.Join(d.Path, name)
-		resp, err := http.Get(u.String())
+	if file, ok := d.Files[name]; ok {
+		p := path.Join(d.Path, name)
+		resp, _, err := endpoints.doHead(p)
 		if err != nil {
 			log.Printf("Lookup(%q) => %v", name, err)
-			return nil, fuse.EIO
+			return nil, syscall.EIO
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
+		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
-		if err != nil {
-			log.Printf("Lookup(%q) => %v", name, err)
-			return nil, fuse.EIO
-		}
 
 		if resp.StatusCode != http.StatusOK {
 			log.Printf("Lookup(%q) => %v", name, resp.Status)
-			return nil, fuse.ENOENT
+			return nil, syscall.ENOENT
 		}
 
 		t, err := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
 		if err != nil {
-			log.Printf("Lookup(%q) => %v", name, err)
-			// keep going
+			t = file.Modified
 		}
 
-		return &File{
-			Path:     u.RequestURI(),
-			Body:     body,
+		headers := make(map[string]string, len(resp.Header))
+		for k, v := range resp.Header {
+			if len(v) > 0 {
+				headers[k] = v[0]
+			}
+		}
+
+		f := &File{
+			Path:     p,
+			Size:     file.Size,
+			OID:      file.OID,
+			ETag:     resp.Header.Get("ETag"),
+			Revno:    resp.Header.Get("X-CBFS-Revno"),
+			Headers:  headers,
 			Modified: t,
 
 			at: time.Now(),
-		}, nil
+		}
+		registry.assign(p, f)
+		return f, nil
 	}
 	if _, ok := d.Dirs[name]; ok {
 		return GetDir(path.Join(d.Path, name))
 	}
-	return nil, fuse.ENOENT
+	return nil, syscall.ENOENT
 }
 
-func (d *Dir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	if d.stale || time.Since(d.at) > time.Minute {
-		n, err := GetDir(d.Path)
-		if err != nil {
+		if err := refreshDir(d); err != nil {
 			return nil, err
 		}
-		*d = *n
 	}
 
 	var ents []fuse.Dirent
@@ -193,248 +318,92 @@ func (d *Dir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 	return ents, nil
 }
 
-func (d *Dir) Create(r *fuse.CreateRequest, w *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
-	if DISABLE_WRITE {
-		return nil, nil, fuse.EPERM
+func (d *Dir) Create(ctx context.Context, r *fuse.CreateRequest, w *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if *readOnly {
+		return nil, nil, syscall.EPERM
 	}
 
-	u := *rootURL
-	u.Path = path.Join(d.Path, r.Name)
-	req, err := http.NewRequest("PUT", u.String(), nil)
-	if err != nil {
-		log.Printf("Create(%q) => %v", u.Path, err)
-		return nil, nil, fuse.EIO
-	}
+	p := path.Join(d.Path, r.Name)
+
+	var mutate func(*http.Request)
 	if int(r.Flags)&os.O_EXCL == os.O_EXCL {
-		req.Header.Set("If-None-Match", "*")
+		mutate = func(req *http.Request) { req.Header.Set("If-None-Match", "*") }
 	} else if int(r.Flags)&os.O_TRUNC != os.O_TRUNC {
-		node, err := d.Lookup(r.Name, intr)
+		node, err := d.Lookup(ctx, r.Name)
 		if err == nil {
-			return node, node.(fuse.Handle), nil
+			return node, node.(fs.Handle), nil
 		}
 	}
-	resp, err := http.DefaultClient.Do(req)
+
+	_, oid, err := endpoints.putQuorum(p, nil, mutate)
 	if err != nil {
-		log.Printf("Create(%q) => %v", u.Path, err)
-		return nil, nil, fuse.EIO
+		log.Printf("Create(%q) => %v", p, err)
+		return nil, nil, syscall.EIO
 	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
 
 	d.stale = true
 
 	f := &File{
-		Path: u.Path,
+		Path: p,
+		OID:  oid,
 
 		at: time.Now(),
 	}
+	registry.assign(p, f)
 	return f, f, nil
 }
 
-func (d *Dir) Remove(r *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
+func (d *Dir) Remove(ctx context.Context, r *fuse.RemoveRequest) error {
+	if *readOnly {
+		return syscall.EPERM
 	}
 
-	u := *rootURL
-	u.Path = path.Join(d.Path, r.Name)
-	req, err := http.NewRequest("DELETE", u.String(), nil)
-	if err != nil {
-		log.Printf("Remove(%q) => %v", u.Path, err)
-		return fuse.EIO
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Remove(%q) => %v", u.Path, err)
-		return fuse.EIO
-	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusNoContent {
-		log.Printf("Remove(%q) => %v", u.Path, resp.Status)
-		return fuse.EIO
+	p := path.Join(d.Path, r.Name)
+	if err := endpoints.deleteQuorum(p); err != nil {
+		log.Printf("Remove(%q) => %v", p, err)
+		return syscall.EIO
 	}
 	d.stale = true
 	return nil
 }
 
-func (d *Dir) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if *readOnly {
+		return syscall.EPERM
 	}
 
 	if d.stale || time.Since(d.at) > time.Minute {
-		n, err := GetDir(d.Path)
-		if err != nil {
+		if err := refreshDir(d); err != nil {
 			return err
 		}
-		*d = *n
 	}
 
-	oldFile, err := d.Lookup(req.OldName, intr)
+	oldFile, err := d.Lookup(ctx, req.OldName)
 	if err != nil {
 		return err
 	}
 
+	nd := newDir.(*Dir)
+	newPath := path.Join(nd.Path, req.NewName)
+
 	switch f := oldFile.(type) {
 	case *File:
-		newFile, _, err := newDir.(*Dir).Create(&fuse.CreateRequest{
-			Name: req.NewName,
-		}, &fuse.CreateResponse{}, intr)
-		if err != nil {
-			return err
-		}
-		body, err := f.ReadAll(intr)
-		if err != nil {
-			return err
-		}
-		err = newFile.(*File).WriteAll(body, intr)
-		if err != nil {
-			return err
+		if err := copyFile(f.Path, newPath, f.OID); err != nil {
+			log.Printf("Rename(%q) => %v", f.Path, err)
+			return syscall.EIO
 		}
-		return d.Remove(&fuse.RemoveRequest{
-			Name: req.OldName,
-		}, intr)
 
 	case *Dir:
-
-	default:
-		return fuse.EIO
-	}
-
-	return fuse.EIO
-}
-
-type File struct {
-	Path     string
-	Body     []byte
-	Modified time.Time
-
-	// internal fields
-	stale bool
-	at    time.Time
-}
-
-func (f *File) Attr() fuse.Attr {
-	return fuse.Attr{
-		Mode:  0644,
-		Size:  uint64(len(f.Body)),
-		Mtime: f.Modified,
-	}
-}
-
-func (f *File) checkStale(intr fuse.Intr) bool {
-	if f.stale || time.Since(f.at) > time.Minute {
-		d, err := GetDir(path.Dir(f.Path))
-		if err != nil {
-			return true
+		if err := renameDirTree(f.Path, newPath); err != nil {
+			log.Printf("Rename(%q) => %v", f.Path, err)
+			return syscall.EIO
 		}
-		node, err := d.Lookup(path.Base(f.Path), intr)
-		if err != nil {
-			return true
-		}
-		if file, _ := node.(*File); file == nil {
-			return true
-		} else {
-			*f = *file
-		}
-	}
-	return false
-}
 
-func (f *File) ReadAll(intr fuse.Intr) ([]byte, fuse.Error) {
-	if f.checkStale(intr) {
-		return nil, fuse.EIO
-	}
-	return f.Body, nil
-}
-
-func (f *File) WriteAll(b []byte, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
-	}
-	if f.checkStale(intr) {
-		return fuse.EIO
-	}
-	u := *rootURL
-	u.Path = f.Path
-	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(b))
-	if err != nil {
-		log.Printf("WriteAll(%q) => %v", f.Path, err)
-		return fuse.EIO
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("WriteAll(%q) => %v", f.Path, err)
-		return fuse.EIO
-	}
-	io.Copy(ioutil.Discard, resp.Body)
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		log.Printf("WriteAll(%q) => %v", f.Path, resp.Status)
-		return fuse.EIO
-	}
-
-	f.stale = true
-
-	return nil
-}
-
-func (f *File) Setattr(r *fuse.SetattrRequest, w *fuse.SetattrResponse, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
-	}
-	f.stale = true // force read
-	if f.checkStale(intr) {
-		return fuse.EIO
-	}
-
-	if r.Valid&fuse.SetattrSize == fuse.SetattrSize {
-		if r.Size < uint64(len(f.Body)) {
-			return f.WriteAll(f.Body[:r.Size], intr)
-		} else {
-			return f.WriteAll(append(f.Body, make([]byte, r.Size-uint64(len(f.Body)))...), intr)
-		}
-	}
-
-	return nil
-}
-
-func (f *File) Flush(r *fuse.FlushRequest, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
-	}
-	return nil
-}
-
-func (f *File) Write(r *fuse.WriteRequest, w *fuse.WriteResponse, intr fuse.Intr) fuse.Error {
-	if DISABLE_WRITE {
-		return fuse.EPERM
-	}
-	f.stale = true // force read
-	if f.checkStale(intr) {
-		return fuse.EIO
-	}
-
-	log.Print(r.Offset)
-
-	w.Size = len(r.Data)
-	log.Print(len(f.Body[r.Offset:]), len(r.Data))
-	if int64(len(f.Body)) < r.Offset+1 {
-		f.Body = append(f.Body, make([]byte, int64(len(f.Body))-r.Offset+1)...)
-	}
-	if len(f.Body[r.Offset:]) > len(r.Data) {
-		copy(f.Body[r.Offset:], r.Data)
-	} else {
-		f.Body = append(f.Body[:r.Offset], r.Data...)
+	default:
+		return syscall.EIO
 	}
-	return f.WriteAll(f.Body, intr)
-}
 
-func (f *File) Fsync(r *fuse.FsyncRequest, intr fuse.Intr) fuse.Error {
-	f.stale = true
-	if f.checkStale(intr) {
-		return fuse.EIO
-	}
+	d.stale = true
+	nd.stale = true
 	return nil
 }
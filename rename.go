@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// maxRenameWorkers bounds how many files a directory rename copies
+// concurrently, so moving a large subtree doesn't open an unbounded number
+// of connections to the CBFS endpoints at once.
+const maxRenameWorkers = 8
+
+// copyFile asks CBFS to copy oid into newPath by reference, so no bytes
+// pass through us, then removes the original.
+func copyFile(oldPath, newPath, oid string) error {
+	_, _, err := endpoints.putQuorum(newPath, nil, func(req *http.Request) {
+		req.Header.Set("X-CBFS-Source-OID", oid)
+	})
+	if err != nil {
+		return fmt.Errorf("copy %s -> %s: %v", oldPath, newPath, err)
+	}
+	if err := endpoints.deleteQuorum(oldPath); err != nil {
+		return fmt.Errorf("copy %s -> %s: delete source: %v", oldPath, newPath, err)
+	}
+	return nil
+}
+
+// renameDirTree recursively copies every file under oldPath to the
+// corresponding path under newPath via copyFile, using a bounded worker
+// pool. CBFS directories are implicit in file paths, so once every file
+// underneath oldPath has been moved out there's nothing left to clean up.
+func renameDirTree(oldPath, newPath string) error {
+	listPath := path.Join("/.cbfs/list", oldPath) + "/?includeMeta=true"
+	resp, _, err := endpoints.doGet(listPath)
+	if err != nil {
+		return fmt.Errorf("list %s: %v", oldPath, err)
+	}
+	defer resp.Body.Close()
+
+	var d Dir
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return fmt.Errorf("list %s: %v", oldPath, err)
+	}
+
+	var (
+		sem   = make(chan struct{}, maxRenameWorkers)
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		mu.Unlock()
+	}
+
+	for name, file := range d.Files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name, oid string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := copyFile(path.Join(oldPath, name), path.Join(newPath, name), oid); err != nil {
+				fail(err)
+			}
+		}(name, file.OID)
+	}
+	wg.Wait()
+
+	for name := range d.Dirs {
+		if err := renameDirTree(path.Join(oldPath, name), path.Join(newPath, name)); err != nil {
+			fail(err)
+		}
+	}
+
+	return first
+}